@@ -1,6 +1,7 @@
-// Package a1 provides simple authentication and authorization helpers for a single
-// user service. Clients should use Hash to hash their password ahead of time,
-// then initialize a Client with using New with the hash so that it may then be
+// Package a1 provides simple authentication and authorization helpers for a
+// service with one or more users. Clients should use Hash to hash a
+// password ahead of time, then initialize a Client with New (single user) or
+// NewUserStore (multiple users, e.g. FileUserStore) so that it may then be
 // used to authenticate web sevices. a1 provides its own simple LoginPage which
 // POSTS to /login to complete the Login flow, as well as a handler for Logout.
 // a1 uses a secure cookie to store the client's login state. a1 also provides
@@ -14,8 +15,10 @@ import (
 	"html/template"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"sync"
 	"time"
 
@@ -27,7 +30,6 @@ import (
 	"github.com/tdewolff/minify/js"
 	"github.com/tdewolff/minify/svg"
 
-	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/net/xsrftoken"
 )
 
@@ -48,44 +50,118 @@ const RedirectPath = "/"
 const CookieName = "Authorization"
 
 // Client holds the state required by a1 to verify a user. A new client can be
-// created using New.
+// created using New or NewUserStore.
 type Client struct {
-	hash []byte
+	store   UserStore
+	backend SessionBackend
+	hasher  Hasher
 
-	lock     sync.Mutex
-	sessions map[string]*session
-	cookie   *securecookie.SecureCookie
+	lock            sync.Mutex
+	oauth2Providers []registeredOAuth2Provider
+	trustedOrigins  map[string]bool
 
-	xsrfKey  string
-	hashKey  []byte
-	blockKey []byte
+	xsrfKey    string
+	totpIssuer string
 }
 
 type session struct {
-	id      string
-	expires time.Time
+	id       string
+	username string
+	email    string
+	expires  time.Time
 }
 
 // Hash returns the hash of a password that should be passed to New and used to
-// authenticate the user.
+// authenticate the user. It is equivalent to (BcryptHasher{}).Hash, but
+// without a1's self-describing "$a1$bcrypt$" prefix; it is kept for
+// compatibility with existing callers and already-stored hashes. New code
+// should use a Hasher (e.g. via NewUserStore(store).WithHasher(...)) directly.
 func Hash(password string) (string, error) {
-	// In case the user chose a short password we SHA512 it first to make
-	// sure all the passwords we bcrypt are of a decent length.
-	sha := sha512.Sum512([]byte(password))
-	bytes, err := bcrypt.GenerateFromPassword(sha[:64], bcrypt.DefaultCost)
-	return string(bytes), err
+	encoded, err := (BcryptHasher{}).Hash(password)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(encoded, hashPrefix+"bcrypt$"), nil
 }
 
 // New takes a hash returned from Hash and returns a new Client which can be
-// used for authenticating users.
+// used for authenticating a single user. For multiple users, use
+// NewUserStore instead.
 func New(hash string) *Client {
+	return NewUserStore(&singleUserStore{hash: []byte(hash)})
+}
+
+// NewUserStore returns a new Client that authenticates users against store,
+// allowing more than one user to log in to the same Client. Login binds each
+// session to the username that was authenticated, retrievable with Username.
+// Sessions are kept in an in-process MemorySessionBackend by default; use
+// WithSessionBackend to pick a different tradeoff.
+func NewUserStore(store UserStore) *Client {
 	return &Client{
-		hash:     []byte(hash),
-		sessions: make(map[string]*session),
-		xsrfKey:  string(generateKey()),
-		hashKey:  generateKey(),
-		blockKey: generateKey(),
+		store:   store,
+		backend: NewMemorySessionBackend(),
+		hasher:  BcryptHasher{},
+		xsrfKey: string(generateKey()),
+	}
+}
+
+// WithSessionBackend replaces c's SessionBackend and returns c for chaining,
+// e.g. a1.NewUserStore(store).WithSessionBackend(a1.NewStatelessSessionBackend(...)).
+// It is only safe to call before c starts serving requests.
+func (c *Client) WithSessionBackend(b SessionBackend) *Client {
+	c.backend = b
+	return c
+}
+
+// WithHasher replaces c's Hasher and returns c for chaining, e.g.
+// a1.NewUserStore(store).WithHasher(a1.Argon2idHasher{}). Users whose stored
+// hash doesn't match the new Hasher's algorithm or parameters are
+// transparently rehashed and persisted back through the UserStore (if it
+// implements UserAdder) on their next successful Login. It is only safe to
+// call before c starts serving requests.
+func (c *Client) WithHasher(h Hasher) *Client {
+	c.hasher = h
+	return c
+}
+
+// WithTOTPIssuer sets the issuer name embedded in the otpauth:// URLs
+// EnrollTOTP and TOTPQRCode generate, shown by authenticator apps alongside
+// the account name. It is only safe to call before c starts serving
+// requests.
+func (c *Client) WithTOTPIssuer(issuer string) *Client {
+	c.totpIssuer = issuer
+	return c
+}
+
+// WithTrustedOrigins registers origins (each a scheme://host[:port], e.g.
+// "https://app.example.com") as safe targets for Login's "next" redirect, in
+// addition to same-origin relative paths. Use this when a1 fronts multiple
+// reverse-proxied services on other hosts (see ForwardAuthRedirect): without
+// it, next is restricted to same-origin relative paths and an absolute next
+// pointing at a proxied app on a different host is dropped, so the user
+// lands on the redirect path on a1's own origin instead of the app they came
+// from. It is only safe to call before c starts serving requests.
+func (c *Client) WithTrustedOrigins(origins ...string) *Client {
+	if c.trustedOrigins == nil {
+		c.trustedOrigins = map[string]bool{}
+	}
+	for _, o := range origins {
+		c.trustedOrigins[o] = true
 	}
+	return c
+}
+
+// RotateKeys asks c's SessionBackend to start signing new sessions with
+// newKey, while still accepting oldKeys for verifying sessions signed before
+// the rotation. It returns an error if the backend doesn't support rotation
+// (see KeyRotator).
+func (c *Client) RotateKeys(newKey []byte, oldKeys ...[]byte) error {
+	r, ok := c.backend.(KeyRotator)
+	if !ok {
+		return fmt.Errorf("a1: %T does not support key rotation", c.backend)
+	}
+	r.RotateKeys(newKey, oldKeys...)
+	return nil
 }
 
 // LoginPage returns a default login page that will POST its form to the
@@ -110,21 +186,65 @@ func (c *Client) CustomLoginPage(favicon, title string, path ...string) http.Han
 			Title     string
 			LoginPath string
 			Token     string
+			Next      string
+			OAuth2    []oauth2Link
 		}{
-			favicon, title, loginPath, c.XSRF(loginPath),
+			favicon, title, loginPath, c.XSRF(loginPath), c.safeNext(r.URL.Query().Get("next")), c.oauth2Links(),
 		})
 	})
 }
 
+// safeNext returns next if it is a same-origin relative path, or an absolute
+// URL whose origin was registered with WithTrustedOrigins, and "" otherwise -
+// so a "next" parameter can never be used to redirect a user to an untrusted
+// site.
+func (c *Client) safeNext(next string) string {
+	if next == "" {
+		return ""
+	}
+	if next[0] == '/' && (len(next) == 1 || next[1] != '/') {
+		return next
+	}
+	if u, err := url.Parse(next); err == nil && u.Scheme != "" && u.Host != "" && c.trustedOrigins[u.Scheme+"://"+u.Host] {
+		return next
+	}
+	return ""
+}
+
+// oauth2Link is the data LoginPage/CustomLoginPage templates use to render a
+// "Sign in with <Name>" button per provider registered with RegisterOAuth2.
+type oauth2Link struct {
+	Name string
+	Path string
+}
+
+func (c *Client) oauth2Links() []oauth2Link {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	links := make([]oauth2Link, len(c.oauth2Providers))
+	for i, p := range c.oauth2Providers {
+		links[i] = oauth2Link{Name: p.provider.Name(), Path: p.loginPath}
+	}
+	return links
+}
+
 // RateLimit restricts the qps of a wrapped handler.
 func RateLimit(qps float64, handler http.Handler) http.Handler {
 	return tollbooth.LimitFuncHandler(tollbooth.NewLimiter(qps, nil), handler.ServeHTTP)
 }
 
-// Login authenticates users provided the password they POST hash to the same
-// hash the client was initialized with. By default, LoginPath is used for
+// Login authenticates users provided the username and password they POST
+// against the Client's UserStore. By default, LoginPath is used for
 // verifying XSRF and users are redirected to RedirectPath after successfully
 // loggin in, but alternatives may be passed in through the paths parameter.
+// If the POST includes a "next" value (as set by ForwardAuthRedirect and
+// carried through by LoginPage/CustomLoginPage's hidden field), users are
+// redirected there instead. If the UserStore implements TOTPStore and the
+// user has TOTP 2FA enabled (see EnrollTOTP and ConfirmTOTP), a correct
+// password isn't enough: Login instead sets a pending-2fa cookie (carrying
+// next along, so LoginTOTP can still honor it) and redirects to TOTPPath to
+// complete the second factor via LoginTOTP.
 func (c *Client) Login(paths ...string) http.Handler {
 	loginPath, redirectPath := LoginPath, RedirectPath
 	if len(paths) >= 1 {
@@ -143,27 +263,35 @@ func (c *Client) Login(paths ...string) http.Handler {
 			httpError(w, 500, errors.New("login request must use POST"))
 		}
 
-		if err := c.checkPassword(r.PostFormValue("password")); err != nil {
+		username, password := r.PostFormValue("username"), r.PostFormValue("password")
+		storedHash, err := c.checkPassword(username, password)
+		if err != nil {
 			httpError(w, 401, err)
 			return
 		}
+		c.maybeRehash(username, password, storedHash)
 
-		session := &session{
-			id:      generateSessionID(),
-			expires: time.Now().AddDate(0, 0, 30),
-		}
+		next := c.safeNext(r.PostFormValue("next"))
 
-		c.lock.Lock()
-		c.sessions[session.id] = session
-		c.lock.Unlock()
+		if store, ok := c.store.(TOTPStore); ok {
+			if _, enabled, err := store.LookupTOTP(username); err == nil && enabled {
+				http.SetCookie(w, c.pendingTOTPCookie(username, next))
+				http.Redirect(w, r, TOTPPath, 302)
+				return
+			}
+		}
 
-		cookie, err := c.newCookie(session)
+		expires := time.Now().AddDate(0, 0, 30)
+		token, err := c.backend.New(username, "", expires)
 		if err != nil {
 			httpError(w, 500, err)
 			return
 		}
-		http.SetCookie(w, cookie)
+		http.SetCookie(w, buildCookie(token, expires))
 
+		if next != "" {
+			redirectPath = next
+		}
 		http.Redirect(w, r, redirectPath, 302)
 	}), loginPath))
 }
@@ -177,19 +305,10 @@ func (c *Client) Logout(path ...string) http.Handler {
 			redirectPath = path[0]
 		}
 
-		http.SetCookie(w, &http.Cookie{
-			Name:     "Authorization",
-			Value:    "",
-			HttpOnly: true,
-			Path:     "/",
-			Expires:  time.Unix(0, 0),
-		})
+		http.SetCookie(w, clearedCookie(CookieName))
 
-		session := c.getSession(r)
-		if session != nil {
-			c.lock.Lock()
-			c.sessions[session.id] = nil
-			c.lock.Unlock()
+		if cookie, err := r.Cookie(CookieName); err == nil {
+			c.backend.Revoke(cookie.Value)
 		}
 
 		http.Redirect(w, r, redirectPath, 302)
@@ -235,6 +354,26 @@ func (c *Client) EnsureAuth(handler http.Handler) http.Handler {
 	})
 }
 
+// EnsureUser wraps a handler like EnsureAuth, but additionally requires the
+// authenticated session's username to be one of names. It is a coarse ACL for
+// Clients backed by a multi-user UserStore.
+func (c *Client) EnsureUser(handler http.Handler, names ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, ok := c.Username(r)
+		if !ok {
+			httpError(w, 401)
+			return
+		}
+		for _, name := range names {
+			if username == name {
+				handler.ServeHTTP(w, r)
+				return
+			}
+		}
+		httpError(w, 403)
+	})
+}
+
 // IsAuth checks whether a request r is authenticated by this client (i.e. the
 // session is present and hasn't expired and the decoded cookie matches the
 // session).
@@ -242,46 +381,95 @@ func (c *Client) IsAuth(r *http.Request) bool {
 	return c.getSession(r) != nil
 }
 
-func (c *Client) getSession(r *http.Request) *session {
-	c.lock.Lock()
-	defer c.lock.Unlock()
-
-	if c.sessions == nil || c.cookie == nil {
-		return nil
+// Username returns the username bound to the request's session, and whether
+// the request was authenticated at all.
+func (c *Client) Username(r *http.Request) (string, bool) {
+	session := c.getSession(r)
+	if session == nil {
+		return "", false
 	}
-	if cookie, err := r.Cookie(CookieName); err == nil {
-		var value string
-		if err = c.cookie.Decode(CookieName, cookie.Value, &value); err == nil {
-			if session, ok := c.sessions[value]; ok {
-				if !session.expires.Before(time.Now()) {
-					return session
-				}
-			}
-		}
+	return session.username, true
+}
+
+// Identity describes the authenticated principal behind a request's
+// session, regardless of whether it came from password Login or an OAuth2
+// provider registered with RegisterOAuth2.
+type Identity struct {
+	// Subject is the username for a password login, or the OAuth2
+	// provider's subject (see oauth2.Identity) for an OAuth2 login.
+	Subject string
+	// Email is only populated for OAuth2 logins whose provider exposes one.
+	Email string
+}
+
+// Identity returns the Identity bound to the request's session, and whether
+// the request was authenticated at all.
+func (c *Client) Identity(r *http.Request) (Identity, bool) {
+	session := c.getSession(r)
+	if session == nil {
+		return Identity{}, false
 	}
-	return nil
+	return Identity{Subject: session.username, Email: session.email}, true
 }
 
-func (c *Client) newCookie(session *session) (*http.Cookie, error) {
-	s := securecookie.New(c.hashKey, c.blockKey)
-	encoded, err := s.Encode(CookieName, session.id)
+func (c *Client) getSession(r *http.Request) *session {
+	cookie, err := r.Cookie(CookieName)
 	if err != nil {
-		return nil, err
+		return nil
 	}
+	return c.backend.Lookup(cookie.Value)
+}
 
-	c.cookie = s
+// buildCookie wraps an opaque SessionBackend token (see SessionBackend.New)
+// in the http.Cookie a1 sets on successful Login/OAuth2Callback.
+func buildCookie(token string, expires time.Time) *http.Cookie {
 	return &http.Cookie{
 		Name:     CookieName,
-		Value:    encoded,
+		Value:    token,
 		HttpOnly: true,
 		Path:     "/",
-		Expires:  session.expires,
-	}, nil
+		Expires:  expires,
+	}
 }
 
-func (c *Client) checkPassword(password string) error {
-	sha := sha512.Sum512([]byte(password))
-	return bcrypt.CompareHashAndPassword(c.hash, sha[:64])
+// dummyHash is a validly-encoded bcrypt hash of no real user's password,
+// verified by checkPassword in place of a real Lookup on an unknown
+// username so that failing because a username doesn't exist takes the same
+// time as failing because its password was wrong - otherwise the two are a
+// timing oracle an attacker can use to enumerate valid usernames.
+const dummyHash = "$a1$bcrypt$$2a$10$EVfn0HNpkFTutgIE8i4pjOtz05LoD7iVqvDwfivlzxoAMpFp55/96"
+
+// checkPassword verifies password against username's stored hash, returning
+// that hash (so the caller can pass it to maybeRehash) if it matched.
+func (c *Client) checkPassword(username, password string) (string, error) {
+	hash, err := c.store.Lookup(username)
+	if err != nil {
+		_ = verifyHash(dummyHash, password)
+		return "", err
+	}
+	if err := verifyHash(string(hash), password); err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// maybeRehash upgrades username's stored hash to c.hasher's current
+// algorithm/parameters if it was stored under different ones, persisting the
+// change back through the UserStore if it supports it (see UserAdder). It is
+// a no-op if c.hasher doesn't implement Rehasher, or the store doesn't
+// implement UserAdder.
+func (c *Client) maybeRehash(username, password, storedHash string) {
+	r, ok := c.hasher.(Rehasher)
+	if !ok || !r.NeedsRehash(storedHash) {
+		return
+	}
+	adder, ok := c.store.(UserAdder)
+	if !ok {
+		return
+	}
+	if hash, err := c.hasher.Hash(password); err == nil {
+		_ = adder.Add(username, []byte(hash))
+	}
 }
 
 func generateSessionID() string {
@@ -0,0 +1,100 @@
+// Command a1passwd manages the entries in a file-backed a1.FileUserStore,
+// analogous to Apache's htpasswd. It adds a user (prompting twice for a
+// password) or, if the user already exists, updates their hash.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/scheibo/a1"
+	"golang.org/x/term"
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s <file> <username>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	remove := flag.Bool("D", false, "remove the given username instead of adding/updating it")
+	hashName := flag.String("hash", "bcrypt", "Hasher to encode new/updated passwords with: bcrypt or argon2id")
+	flag.Parse()
+
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	path, username := flag.Arg(0), flag.Arg(1)
+
+	hasher, err := hasherFor(*hashName)
+	if err != nil {
+		fatal(err)
+	}
+
+	store, err := a1.NewFileUserStore(path)
+	if err != nil {
+		fatal(err)
+	}
+
+	if *remove {
+		if err := store.Remove(username); err != nil {
+			fatal(err)
+		}
+		return
+	}
+
+	password, err := readPassword()
+	if err != nil {
+		fatal(err)
+	}
+
+	hash, err := hasher.Hash(password)
+	if err != nil {
+		fatal(err)
+	}
+
+	if err := store.Add(username, []byte(hash)); err != nil {
+		fatal(err)
+	}
+}
+
+func readPassword() (string, error) {
+	fmt.Fprint(os.Stderr, "New password: ")
+	password, err := term.ReadPassword(int(syscall.Stdin))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Fprint(os.Stderr, "Re-type new password: ")
+	confirm, err := term.ReadPassword(int(syscall.Stdin))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+
+	if string(password) != string(confirm) {
+		return "", fmt.Errorf("a1passwd: passwords don't match")
+	}
+	return string(password), nil
+}
+
+// hasherFor returns the a1.Hasher named by name, matching the algorithms
+// a1's self-describing hash encoding supports.
+func hasherFor(name string) (a1.Hasher, error) {
+	switch name {
+	case "bcrypt":
+		return a1.BcryptHasher{}, nil
+	case "argon2id":
+		return a1.Argon2idHasher{}, nil
+	default:
+		return nil, fmt.Errorf("a1passwd: unknown hash algorithm %q", name)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "a1passwd: %s\n", err)
+	os.Exit(1)
+}
@@ -0,0 +1,82 @@
+package a1
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// ForwardAuth returns a handler suitable for Traefik's forwardAuth or
+// Caddy's forward_auth middleware: it responds 200, with X-Forwarded-User
+// and X-Forwarded-Email headers set from the session, when the request
+// carries a valid a1 cookie, and 401 otherwise.
+func (c *Client) ForwardAuth() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session := c.getSession(r)
+		if session == nil {
+			httpError(w, 401)
+			return
+		}
+		setForwardedHeaders(w, session)
+	})
+}
+
+// ForwardAuthRedirect is like ForwardAuth, but instead of responding 401 to
+// an unauthenticated request, it redirects to loginURL with the original
+// destination (reconstructed from the X-Forwarded-* headers the reverse
+// proxy sets) in a "next" query parameter. Pair it with a Login that will
+// honor next on success.
+//
+// The proxied app this protects is usually on a different host than a1's
+// own login page - that's the point of fronting Traefik/Caddy forward-auth
+// for arbitrary reverse-proxied services - so next is naturally a
+// cross-origin absolute URL. Login's safeNext check rejects any next that
+// isn't same-origin relative unless its origin was registered with
+// WithTrustedOrigins: register every host ForwardAuth/ForwardAuthRedirect
+// protects there, or next is silently dropped and users land on RedirectPath
+// instead of back on the app they came from.
+func (c *Client) ForwardAuthRedirect(loginURL string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session := c.getSession(r)
+		if session == nil {
+			u, err := url.Parse(loginURL)
+			if err != nil {
+				httpError(w, 500, err)
+				return
+			}
+			q := u.Query()
+			q.Set("next", c.safeNext(originalURL(r)))
+			u.RawQuery = q.Encode()
+			http.Redirect(w, r, u.String(), http.StatusFound)
+			return
+		}
+		setForwardedHeaders(w, session)
+	})
+}
+
+func setForwardedHeaders(w http.ResponseWriter, session *session) {
+	w.Header().Set("X-Forwarded-User", session.username)
+	w.Header().Set("X-Forwarded-Email", session.email)
+	w.WriteHeader(http.StatusOK)
+}
+
+// originalURL reconstructs the URL of the request a reverse proxy is asking
+// a1 to authorize on behalf of, from the X-Forwarded-Proto/-Host/-Uri
+// headers set by Traefik's forwardAuth and Caddy's forward_auth
+// middlewares. It falls back to r.URL if those headers are absent, e.g. when
+// ForwardAuthRedirect is reached directly rather than via a reverse proxy.
+// The caller is responsible for validating the result (see
+// Client.ForwardAuthRedirect's use of safeNext) before handing it to a user
+// as a redirect target.
+func originalURL(r *http.Request) string {
+	proto := r.Header.Get("X-Forwarded-Proto")
+	host := r.Header.Get("X-Forwarded-Host")
+	if proto == "" || host == "" {
+		return r.URL.String()
+	}
+	uri := r.Header.Get("X-Forwarded-Uri")
+	if uri == "" {
+		uri = "/"
+	}
+	return fmt.Sprintf("%s://%s%s", proto, host, uri)
+}
@@ -0,0 +1,221 @@
+package a1
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// hashPrefix marks a hash as one of a1's self-describing encodings, e.g.
+// "$a1$bcrypt$..." or "$a1$argon2id$m=65536,t=3,p=2$salt$hash".
+const hashPrefix = "$a1$"
+
+// Hasher hashes and verifies passwords for storage in a UserStore. Because
+// encoded hashes are self-describing, a Client's Hasher can be swapped
+// without invalidating hashes produced by a previous one: Login transparently
+// rehashes and persists the upgrade (see Rehasher) the next time a user with
+// an old-format hash signs in successfully.
+type Hasher interface {
+	Hash(password string) (string, error)
+	Verify(encoded, password string) error
+}
+
+// Rehasher is implemented by Hashers that can recognize a hash encoded with
+// different parameters than they're currently configured with, letting Login
+// transparently rehash and persist the upgrade on the next successful login.
+type Rehasher interface {
+	NeedsRehash(encoded string) bool
+}
+
+// hashVerifiers maps the "alg" segment of a "$a1$alg$..." encoded hash to a
+// Hasher able to Verify it, so verifyHash can dispatch on what the hash
+// itself says it is rather than assuming it matches a Client's currently
+// configured Hasher. Zero-value Hashers are fine here: Verify never depends
+// on tunable parameters (cost, time/memory/threads), only on what's encoded
+// in the hash.
+var hashVerifiers = map[string]Hasher{
+	"bcrypt":   BcryptHasher{},
+	"argon2id": Argon2idHasher{},
+}
+
+// verifyHash verifies password against encoded, dispatching to the Hasher
+// matching encoded's "$a1$<alg>$" prefix - or BcryptHasher for legacy,
+// unprefixed hashes - instead of assuming encoded was produced by a specific
+// Hasher. This is what lets a deployment migrate from one algorithm to
+// another simply by changing the Client's Hasher: existing hashes keep
+// verifying under their own algorithm until Login's rehash-on-success logic
+// upgrades them.
+func verifyHash(encoded, password string) error {
+	alg := "bcrypt"
+	if strings.HasPrefix(encoded, hashPrefix) {
+		alg = strings.SplitN(strings.TrimPrefix(encoded, hashPrefix), "$", 2)[0]
+	}
+	h, ok := hashVerifiers[alg]
+	if !ok {
+		return fmt.Errorf("a1: unknown hash algorithm %q", alg)
+	}
+	return h.Verify(encoded, password)
+}
+
+// BcryptHasher hashes passwords with bcrypt, a1's default Hasher (kept for
+// backward compatibility with hashes produced by the original, unprefixed
+// Hash function). As bcrypt truncates its input at 72 bytes, passwords are
+// SHA-512'd first so a long password doesn't lose entropy.
+type BcryptHasher struct {
+	// Cost is the bcrypt cost parameter; 0 uses bcrypt.DefaultCost.
+	Cost int
+}
+
+func (h BcryptHasher) cost() int {
+	if h.Cost == 0 {
+		return bcrypt.DefaultCost
+	}
+	return h.Cost
+}
+
+// Hash implements Hasher.
+func (h BcryptHasher) Hash(password string) (string, error) {
+	sha := sha512.Sum512([]byte(password))
+	hash, err := bcrypt.GenerateFromPassword(sha[:64], h.cost())
+	if err != nil {
+		return "", err
+	}
+	return hashPrefix + "bcrypt$" + string(hash), nil
+}
+
+// Verify implements Hasher. It also accepts hashes produced by the original,
+// unprefixed Hash function.
+func (h BcryptHasher) Verify(encoded, password string) error {
+	hash := strings.TrimPrefix(encoded, hashPrefix+"bcrypt$")
+	sha := sha512.Sum512([]byte(password))
+	return bcrypt.CompareHashAndPassword([]byte(hash), sha[:64])
+}
+
+// NeedsRehash implements Rehasher, reporting true for any hash that isn't
+// already in our own prefixed bcrypt format at our configured cost -
+// including legacy hashes from the original, unprefixed Hash function.
+func (h BcryptHasher) NeedsRehash(encoded string) bool {
+	hash := strings.TrimPrefix(encoded, hashPrefix+"bcrypt$")
+	if hash == encoded {
+		return true
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != h.cost()
+}
+
+// Argon2idHasher hashes passwords with argon2id, which - unlike bcrypt - has
+// no input length limit and is tunable to modern hardware.
+type Argon2idHasher struct {
+	// Time, Memory (in KiB), and Threads are argon2id parameters; zero
+	// values fall back to reasonable defaults.
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+}
+
+const (
+	argon2idDefaultTime    = 3
+	argon2idDefaultMemory  = 64 * 1024
+	argon2idDefaultThreads = 2
+	argon2idKeyLen         = 32
+	argon2idSaltLen        = 16
+)
+
+func (h Argon2idHasher) params() (t, m uint32, p uint8) {
+	t, m, p = h.Time, h.Memory, h.Threads
+	if t == 0 {
+		t = argon2idDefaultTime
+	}
+	if m == 0 {
+		m = argon2idDefaultMemory
+	}
+	if p == 0 {
+		p = argon2idDefaultThreads
+	}
+	return
+}
+
+// Hash implements Hasher.
+func (h Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, argon2idSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	t, m, p := h.params()
+	hash := argon2.IDKey([]byte(password), salt, t, m, p, argon2idKeyLen)
+
+	return fmt.Sprintf("%sargon2id$m=%d,t=%d,p=%d$%s$%s",
+		hashPrefix, m, t, p,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(hash),
+	), nil
+}
+
+// Verify implements Hasher.
+func (h Argon2idHasher) Verify(encoded, password string) error {
+	t, m, p, salt, hash, err := parseArgon2id(encoded)
+	if err != nil {
+		return err
+	}
+
+	got := argon2.IDKey([]byte(password), salt, t, m, p, uint32(len(hash)))
+	if subtle.ConstantTimeCompare(got, hash) != 1 {
+		return fmt.Errorf("a1: password doesn't match hash")
+	}
+	return nil
+}
+
+// NeedsRehash implements Rehasher.
+func (h Argon2idHasher) NeedsRehash(encoded string) bool {
+	t, m, p, _, _, err := parseArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+	wantTime, wantMemory, wantThreads := h.params()
+	return t != wantTime || m != wantMemory || p != wantThreads
+}
+
+// parseArgon2id parses a "$a1$argon2id$m=...,t=...,p=...$salt$hash" hash.
+func parseArgon2id(encoded string) (t, m uint32, p uint8, salt, hash []byte, err error) {
+	parts := strings.Split(encoded, "$")
+	// Splitting "$a1$argon2id$m=...,t=...,p=...$salt$hash" on "$" yields
+	// ["", "a1", "argon2id", "m=...,t=...,p=...", "salt", "hash"].
+	if len(parts) != 6 || parts[1] != "a1" || parts[2] != "argon2id" {
+		return 0, 0, 0, nil, nil, fmt.Errorf("a1: not an argon2id hash")
+	}
+
+	for _, kv := range strings.Split(parts[3], ",") {
+		pair := strings.SplitN(kv, "=", 2)
+		if len(pair) != 2 {
+			return 0, 0, 0, nil, nil, fmt.Errorf("a1: malformed argon2id params %q", parts[3])
+		}
+		v, err := strconv.ParseUint(pair[1], 10, 32)
+		if err != nil {
+			return 0, 0, 0, nil, nil, err
+		}
+		switch pair[0] {
+		case "m":
+			m = uint32(v)
+		case "t":
+			t = uint32(v)
+		case "p":
+			p = uint8(v)
+		}
+	}
+
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return 0, 0, 0, nil, nil, err
+	}
+	if hash, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return 0, 0, 0, nil, nil, err
+	}
+	return t, m, p, salt, hash, nil
+}
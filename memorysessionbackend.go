@@ -0,0 +1,96 @@
+package a1
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+const memorySessionCookieName = "a1-session"
+
+// MemorySessionBackend is the default SessionBackend, used by New and
+// NewUserStore: sessions live in an in-process map, and the cookie only
+// carries a signed reference to the map key. Sessions don't survive restarts
+// and aren't shared across instances; use a StatelessSessionBackend for
+// that.
+type MemorySessionBackend struct {
+	lock     sync.Mutex
+	sessions map[string]*session
+	codecs   []securecookie.Codec
+}
+
+// NewMemorySessionBackend returns a MemorySessionBackend ready for use, with
+// a freshly generated signing key.
+func NewMemorySessionBackend() *MemorySessionBackend {
+	b := &MemorySessionBackend{sessions: make(map[string]*session)}
+	b.RotateKeys(generateKey())
+	return b
+}
+
+// New implements SessionBackend.
+func (b *MemorySessionBackend) New(username, email string, expires time.Time) (string, error) {
+	s := &session{id: generateSessionID(), username: username, email: email, expires: expires}
+
+	b.lock.Lock()
+	b.sessions[s.id] = s
+	codecs := b.codecs
+	b.lock.Unlock()
+
+	return securecookie.EncodeMulti(memorySessionCookieName, s.id, codecs...)
+}
+
+// Lookup implements SessionBackend.
+func (b *MemorySessionBackend) Lookup(token string) *session {
+	b.lock.Lock()
+	codecs := b.codecs
+	b.lock.Unlock()
+
+	var id string
+	if err := securecookie.DecodeMulti(memorySessionCookieName, token, &id, codecs...); err != nil {
+		return nil
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	s, ok := b.sessions[id]
+	if !ok || s.expires.Before(time.Now()) {
+		return nil
+	}
+	return s
+}
+
+// Revoke implements SessionBackend.
+func (b *MemorySessionBackend) Revoke(token string) {
+	b.lock.Lock()
+	codecs := b.codecs
+	b.lock.Unlock()
+
+	var id string
+	if err := securecookie.DecodeMulti(memorySessionCookieName, token, &id, codecs...); err != nil {
+		return
+	}
+
+	b.lock.Lock()
+	delete(b.sessions, id)
+	b.lock.Unlock()
+}
+
+// RotateKeys implements KeyRotator. newKey and each of oldKeys are expanded
+// into a securecookie hash/block key pair (the block key is derived with
+// SHA-256, since encryption here is secondary to tamper-detection) and fed
+// to securecookie.CodecsFromPairs, so newly-issued cookies sign with newKey
+// while cookies signed with an old key still decode.
+func (b *MemorySessionBackend) RotateKeys(newKey []byte, oldKeys ...[]byte) {
+	keys := append([][]byte{newKey}, oldKeys...)
+	pairs := make([][]byte, 0, len(keys)*2)
+	for _, k := range keys {
+		block := sha256.Sum256(k)
+		pairs = append(pairs, k, block[:])
+	}
+
+	b.lock.Lock()
+	b.codecs = securecookie.CodecsFromPairs(pairs...)
+	b.lock.Unlock()
+}
@@ -0,0 +1,233 @@
+// Package oauth2 provides OAuth2/OIDC login Providers for use with
+// a1.Client's OAuth2Login and OAuth2Callback. Build a Provider with NewGitHub
+// or NewOIDC and register it with a1.Client.RegisterOAuth2.
+package oauth2
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/github"
+)
+
+// Identity describes the user a Provider authenticated, regardless of which
+// provider was used.
+type Identity struct {
+	// Subject is a stable, globally unique identifier for the user,
+	// namespaced by provider (e.g. "github:123") or issuer (e.g.
+	// "https://accounts.example.com:abc123" for OIDC) so registering
+	// multiple providers can't collide two different users onto the same
+	// a1 identity.
+	Subject string
+	// Email is the user's email address, if the provider exposes one.
+	Email string
+	// EmailVerified reports whether the provider has verified Email.
+	EmailVerified bool
+}
+
+// Provider implements a single OAuth2/OIDC login flow on behalf of
+// a1.Client.OAuth2Login and OAuth2Callback.
+type Provider interface {
+	// Name identifies the provider, e.g. "github" or "google", for use in
+	// URLs and "Sign in with Name" buttons.
+	Name() string
+	// PKCE reports whether this Provider requires a PKCE code_verifier, as
+	// is typical for public clients that have no client secret.
+	PKCE() bool
+	// AuthCodeURL returns the URL to redirect the user to in order to begin
+	// the flow. pkce is the verifier generated for this attempt, or "" if
+	// PKCE returns false.
+	AuthCodeURL(state, pkce string) string
+	// Exchange completes the flow given the "code" from the provider's
+	// redirect to the callback, and the same pkce verifier passed to
+	// AuthCodeURL.
+	Exchange(ctx context.Context, code, pkce string) (*Identity, error)
+}
+
+// GeneratePKCE returns a random PKCE code_verifier suitable for passing to a
+// Provider whose PKCE method returns true.
+func GeneratePKCE() string {
+	b := make([]byte, 32)
+	_, _ = rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func pkceOpts(pkce string) []oauth2.AuthCodeOption {
+	if pkce == "" {
+		return nil
+	}
+	return []oauth2.AuthCodeOption{
+		oauth2.SetAuthURLParam("code_challenge", pkceChallenge(pkce)),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+	}
+}
+
+func pkceExchangeOpts(pkce string) []oauth2.AuthCodeOption {
+	if pkce == "" {
+		return nil
+	}
+	return []oauth2.AuthCodeOption{oauth2.SetAuthURLParam("code_verifier", pkce)}
+}
+
+// githubProvider implements Provider for GitHub. GitHub has no ID tokens, so
+// Exchange fetches the identity from the userinfo-equivalent /user endpoint.
+type githubProvider struct {
+	config *oauth2.Config
+	pkce   bool
+}
+
+// NewGitHub returns a Provider for signing in with a GitHub OAuth app. If
+// clientSecret is empty, the provider is treated as a public client and uses
+// PKCE instead.
+func NewGitHub(clientID, clientSecret, redirectURL string, scopes ...string) Provider {
+	if len(scopes) == 0 {
+		scopes = []string{"read:user", "user:email"}
+	}
+	return &githubProvider{
+		config: &oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			Endpoint:     github.Endpoint,
+			RedirectURL:  redirectURL,
+			Scopes:       scopes,
+		},
+		pkce: clientSecret == "",
+	}
+}
+
+func (p *githubProvider) Name() string { return "github" }
+func (p *githubProvider) PKCE() bool   { return p.pkce }
+
+func (p *githubProvider) AuthCodeURL(state, pkce string) string {
+	return p.config.AuthCodeURL(state, pkceOpts(pkce)...)
+}
+
+func (p *githubProvider) Exchange(ctx context.Context, code, pkce string) (*Identity, error) {
+	token, err := p.config.Exchange(ctx, code, pkceExchangeOpts(pkce)...)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("GET", "https://api.github.com/user", nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	resp, err := p.config.Client(ctx, token).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oauth2: github /user returned %s: %s", resp.Status, body)
+	}
+
+	var user struct {
+		ID    int    `json:"id"`
+		Email string `json:"email"`
+	}
+	if err := json.Unmarshal(body, &user); err != nil {
+		return nil, err
+	}
+
+	return &Identity{
+		Subject:       fmt.Sprintf("github:%d", user.ID),
+		Email:         user.Email,
+		EmailVerified: user.Email != "",
+	}, nil
+}
+
+// oidcProvider implements Provider for a generic OpenID Connect issuer,
+// discovered via the standard /.well-known/openid-configuration document.
+type oidcProvider struct {
+	name     string
+	issuer   string
+	config   *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+	pkce     bool
+}
+
+// NewOIDC discovers issuer's configuration and returns a Provider for
+// signing in with it, identified as name (used for its "Sign in with <name>"
+// button and PKCE cookie) so callers can register more than one OIDC issuer
+// distinguishably. If clientSecret is empty, the provider is treated as a
+// public client and uses PKCE instead.
+func NewOIDC(ctx context.Context, name, issuer, clientID, clientSecret, redirectURL string, scopes ...string) (Provider, error) {
+	p, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(scopes) == 0 {
+		scopes = []string{oidc.ScopeOpenID, "email", "profile"}
+	}
+
+	return &oidcProvider{
+		name:   name,
+		issuer: issuer,
+		config: &oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			Endpoint:     p.Endpoint(),
+			RedirectURL:  redirectURL,
+			Scopes:       scopes,
+		},
+		verifier: p.Verifier(&oidc.Config{ClientID: clientID}),
+		pkce:     clientSecret == "",
+	}, nil
+}
+
+func (p *oidcProvider) Name() string { return p.name }
+func (p *oidcProvider) PKCE() bool   { return p.pkce }
+
+func (p *oidcProvider) AuthCodeURL(state, pkce string) string {
+	return p.config.AuthCodeURL(state, pkceOpts(pkce)...)
+}
+
+func (p *oidcProvider) Exchange(ctx context.Context, code, pkce string) (*Identity, error) {
+	token, err := p.config.Exchange(ctx, code, pkceExchangeOpts(pkce)...)
+	if err != nil {
+		return nil, err
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, fmt.Errorf("oauth2: token response missing id_token")
+	}
+	idToken, err := p.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims struct {
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, err
+	}
+
+	return &Identity{
+		Subject:       p.issuer + ":" + idToken.Subject,
+		Email:         claims.Email,
+		EmailVerified: claims.EmailVerified,
+	}, nil
+}
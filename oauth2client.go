@@ -0,0 +1,144 @@
+package a1
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/xsrftoken"
+
+	"github.com/scheibo/a1/oauth2"
+)
+
+// registeredOAuth2Provider pairs a provider registered with RegisterOAuth2
+// with the path CustomLoginPage should link its "Sign in with" button to.
+type registeredOAuth2Provider struct {
+	provider  oauth2.Provider
+	loginPath string
+}
+
+// RegisterOAuth2 makes provider available as a "Sign in with <Name>" button
+// on LoginPage/CustomLoginPage, linking to loginPath (the path the caller
+// mounts provider's OAuth2Login handler at). It does not itself install any
+// handlers; callers still need to mount OAuth2Login and OAuth2Callback.
+func (c *Client) RegisterOAuth2(provider oauth2.Provider, loginPath string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.oauth2Providers = append(c.oauth2Providers, registeredOAuth2Provider{provider, loginPath})
+}
+
+func oauth2Action(provider oauth2.Provider, action string) string {
+	if action != "" {
+		return action
+	}
+	return "oauth2:" + provider.Name()
+}
+
+func oauth2PKCECookieName(provider oauth2.Provider) string {
+	return "a1-pkce-" + provider.Name()
+}
+
+func oauth2NonceCookieName(provider oauth2.Provider) string {
+	return "a1-oauth2-nonce-" + provider.Name()
+}
+
+// OAuth2Login returns a handler that begins provider's login flow by
+// redirecting the user to its authorize endpoint. The state parameter
+// combines a random per-request nonce, stashed in an HttpOnly cookie, with
+// the same xsrftoken machinery as CheckXSRF (scoped to the optional action
+// argument, defaulting to "oauth2:" plus the provider's Name); OAuth2Callback requires both
+// to match, so an attacker who obtains a validly-signed state of their own
+// can't hand it to a victim to complete a login-CSRF (RFC 6749 §10.12).
+func (c *Client) OAuth2Login(provider oauth2.Provider, action ...string) http.Handler {
+	a := ""
+	if len(action) > 0 {
+		a = action[0]
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonce := oauth2.GeneratePKCE()
+		http.SetCookie(w, &http.Cookie{
+			Name:     oauth2NonceCookieName(provider),
+			Value:    nonce,
+			HttpOnly: true,
+			Path:     "/",
+			Expires:  time.Now().Add(10 * time.Minute),
+		})
+
+		state := xsrftoken.Generate(c.xsrfKey, "", oauth2Action(provider, a)) + "." + nonce
+
+		pkce := ""
+		if provider.PKCE() {
+			pkce = oauth2.GeneratePKCE()
+			http.SetCookie(w, &http.Cookie{
+				Name:     oauth2PKCECookieName(provider),
+				Value:    pkce,
+				HttpOnly: true,
+				Path:     "/",
+				Expires:  time.Now().Add(10 * time.Minute),
+			})
+		}
+
+		http.Redirect(w, r, provider.AuthCodeURL(state, pkce), http.StatusFound)
+	})
+}
+
+// OAuth2Callback returns a handler that completes provider's login flow:
+// verifying state, exchanging the authorization code for the user's
+// Identity, and - on success - issuing the same kind of session cookie
+// password Login produces, bound to that Identity. Users are redirected to
+// the optional redirect path passed in or RedirectPath; action must match
+// whatever was passed to OAuth2Login.
+func (c *Client) OAuth2Callback(provider oauth2.Provider, action, redirectPath string) http.Handler {
+	if redirectPath == "" {
+		redirectPath = RedirectPath
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			httpError(w, 500, err)
+			return
+		}
+
+		state := r.Form.Get("state")
+		sig, nonce, ok := strings.Cut(state, ".")
+		if !ok || !xsrftoken.Valid(sig, c.xsrfKey, "", oauth2Action(provider, action)) {
+			httpError(w, 401, errors.New("oauth2: invalid state"))
+			return
+		}
+
+		nonceCookie, err := r.Cookie(oauth2NonceCookieName(provider))
+		if err != nil || subtle.ConstantTimeCompare([]byte(nonceCookie.Value), []byte(nonce)) != 1 {
+			httpError(w, 401, errors.New("oauth2: state nonce mismatch"))
+			return
+		}
+
+		pkce := ""
+		if provider.PKCE() {
+			cookie, err := r.Cookie(oauth2PKCECookieName(provider))
+			if err != nil {
+				httpError(w, 401, errors.New("oauth2: missing pkce verifier"))
+				return
+			}
+			pkce = cookie.Value
+		}
+
+		identity, err := provider.Exchange(r.Context(), r.Form.Get("code"), pkce)
+		if err != nil {
+			httpError(w, 401, err)
+			return
+		}
+
+		expires := time.Now().AddDate(0, 0, 30)
+		token, err := c.backend.New(identity.Subject, identity.Email, expires)
+		if err != nil {
+			httpError(w, 500, err)
+			return
+		}
+		http.SetCookie(w, buildCookie(token, expires))
+
+		http.Redirect(w, r, redirectPath, http.StatusFound)
+	})
+}
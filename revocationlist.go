@@ -0,0 +1,135 @@
+package a1
+
+import (
+	"bufio"
+	"container/list"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// RevocationList is a small, bounded cache of revoked session nonces, used by
+// StatelessSessionBackend.Revoke to make Logout meaningful for an otherwise
+// stateless backend. Once capacity is reached it evicts its oldest entry -
+// from the backing file as well as memory - so it bounds both at the cost of
+// eventually forgetting very old revocations - acceptable since by then
+// those sessions will have expired anyway.
+type RevocationList struct {
+	path     string
+	capacity int
+
+	lock    sync.Mutex
+	entries *list.List
+	index   map[string]*list.Element
+}
+
+// NewRevocationList returns a RevocationList holding at most capacity
+// nonces. If path is non-empty, it is loaded from (one nonce per line) and
+// appended to as nonces are revoked, so revocations survive restarts.
+func NewRevocationList(capacity int, path string) (*RevocationList, error) {
+	rl := &RevocationList{
+		path:     path,
+		capacity: capacity,
+		entries:  list.New(),
+		index:    make(map[string]*list.Element),
+	}
+	if path == "" {
+		return rl, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if nonce := scanner.Text(); nonce != "" {
+			rl.add(nonce)
+		}
+	}
+	return rl, scanner.Err()
+}
+
+// Add revokes nonce, evicting the oldest revoked nonce if the list is at
+// capacity, and persists the change to the backing file if one was
+// provided. Ordinary additions are appended; once capacity forces an
+// eviction, the file is instead rewritten from the current in-memory
+// entries, so - like the in-memory cache it mirrors - it stays bounded at
+// capacity rather than growing forever.
+func (rl *RevocationList) Add(nonce string) error {
+	rl.lock.Lock()
+	inserted, evicted := rl.add(nonce)
+	var snapshot []string
+	if evicted {
+		snapshot = make([]string, 0, rl.entries.Len())
+		for e := rl.entries.Front(); e != nil; e = e.Next() {
+			snapshot = append(snapshot, e.Value.(string))
+		}
+	}
+	rl.lock.Unlock()
+
+	if rl.path == "" || !inserted {
+		return nil
+	}
+	if evicted {
+		return rl.rewrite(snapshot)
+	}
+	return rl.append(nonce)
+}
+
+// add records nonce, reporting whether it was newly inserted and whether
+// doing so evicted the oldest entry to stay within capacity. Callers must
+// hold rl.lock.
+func (rl *RevocationList) add(nonce string) (inserted, evicted bool) {
+	if _, ok := rl.index[nonce]; ok {
+		return false, false
+	}
+	if rl.capacity > 0 && rl.entries.Len() >= rl.capacity {
+		oldest := rl.entries.Front()
+		rl.entries.Remove(oldest)
+		delete(rl.index, oldest.Value.(string))
+		evicted = true
+	}
+	rl.index[nonce] = rl.entries.PushBack(nonce)
+	return true, evicted
+}
+
+// append adds nonce as a new line to the backing file.
+func (rl *RevocationList) append(nonce string) error {
+	f, err := os.OpenFile(rl.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintln(f, nonce)
+	return err
+}
+
+// rewrite replaces the backing file's contents with entries, compacting
+// away nonces already evicted from memory.
+func (rl *RevocationList) rewrite(entries []string) error {
+	f, err := os.OpenFile(rl.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	for _, nonce := range entries {
+		if _, err := fmt.Fprintln(w, nonce); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// Contains reports whether nonce has been revoked.
+func (rl *RevocationList) Contains(nonce string) bool {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	_, ok := rl.index[nonce]
+	return ok
+}
@@ -0,0 +1,28 @@
+package a1
+
+import "time"
+
+// SessionBackend creates, looks up, and revokes the sessions behind a
+// Client's login cookie. NewMemorySessionBackend (the default, used by New
+// and NewUserStore) keeps sessions in an in-process map; NewStatelessSessionBackend
+// signs self-contained tokens instead, so sessions survive restarts and work
+// across multiple instances. Install one with Client.WithSessionBackend.
+type SessionBackend interface {
+	// New creates a session for username/email expiring at expires, and
+	// returns the opaque value to use as the session cookie.
+	New(username, email string, expires time.Time) (token string, err error)
+	// Lookup reconstructs the session referenced by token, or returns nil
+	// if token is missing, malformed, expired, or revoked.
+	Lookup(token string) *session
+	// Revoke invalidates token so a subsequent Lookup returns nil.
+	Revoke(token string)
+}
+
+// KeyRotator is implemented by SessionBackends that support rotating their
+// signing key without invalidating sessions signed with a previous one; see
+// Client.RotateKeys.
+type KeyRotator interface {
+	// RotateKeys starts signing new sessions with newKey, while still
+	// accepting oldKeys for verifying sessions signed before the rotation.
+	RotateKeys(newKey []byte, oldKeys ...[]byte)
+}
@@ -0,0 +1,146 @@
+package a1
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statelessPayloadSep separates the fields packed into a
+// StatelessSessionBackend token's payload. Usernames and emails are assumed
+// not to contain it, the same assumption FileUserStore makes about ":".
+const statelessPayloadSep = "\x00"
+
+// StatelessSessionBackend signs self-contained session tokens instead of
+// keeping sessions in memory: the cookie value is
+// base64(username||email||expires||nonce) + "." + base64(HMAC-SHA256(key, payload)),
+// so Lookup never needs to consult a map, and sessions survive restarts and
+// scale horizontally. Pair it with a RevocationList to make Logout (Revoke)
+// meaningful despite the backend otherwise being stateless.
+type StatelessSessionBackend struct {
+	revoked *RevocationList
+
+	lock    sync.Mutex
+	key     []byte
+	oldKeys [][]byte
+}
+
+// NewStatelessSessionBackend returns a StatelessSessionBackend signing with
+// key. revoked may be nil, in which case Revoke is a no-op: Logout will still
+// clear the cookie, but a copy of the token made before logout would still
+// verify if replayed.
+func NewStatelessSessionBackend(key []byte, revoked *RevocationList) *StatelessSessionBackend {
+	return &StatelessSessionBackend{key: key, revoked: revoked}
+}
+
+// New implements SessionBackend.
+func (b *StatelessSessionBackend) New(username, email string, expires time.Time) (string, error) {
+	nonce, err := generateNonce()
+	if err != nil {
+		return "", err
+	}
+	payload := strings.Join(
+		[]string{username, email, strconv.FormatInt(expires.Unix(), 10), nonce},
+		statelessPayloadSep,
+	)
+
+	b.lock.Lock()
+	key := b.key
+	b.lock.Unlock()
+
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(sign(key, payload)), nil
+}
+
+// Lookup implements SessionBackend.
+func (b *StatelessSessionBackend) Lookup(token string) *session {
+	nonce, username, email, expires, ok := b.verify(token)
+	if !ok || expires.Before(time.Now()) {
+		return nil
+	}
+	if b.revoked != nil && b.revoked.Contains(nonce) {
+		return nil
+	}
+	return &session{id: nonce, username: username, email: email, expires: expires}
+}
+
+// Revoke implements SessionBackend by recording token's nonce in the
+// RevocationList (if one was provided), so future Lookups reject it.
+func (b *StatelessSessionBackend) Revoke(token string) {
+	if b.revoked == nil {
+		return
+	}
+	if nonce, _, _, _, ok := b.verify(token); ok {
+		_ = b.revoked.Add(nonce)
+	}
+}
+
+// RotateKeys implements KeyRotator.
+func (b *StatelessSessionBackend) RotateKeys(newKey []byte, oldKeys ...[]byte) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.key, b.oldKeys = newKey, oldKeys
+}
+
+// verify checks token's signature against the active key and any retained
+// oldKeys, and parses its payload if one of them matches.
+func (b *StatelessSessionBackend) verify(token string) (nonce, username, email string, expires time.Time, ok bool) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return
+	}
+
+	b.lock.Lock()
+	keys := append([][]byte{b.key}, b.oldKeys...)
+	b.lock.Unlock()
+
+	verified := false
+	for _, key := range keys {
+		if hmac.Equal(sign(key, string(payload)), sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return
+	}
+
+	fields := strings.Split(string(payload), statelessPayloadSep)
+	if len(fields) != 4 {
+		return "", "", "", time.Time{}, false
+	}
+	unix, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return "", "", "", time.Time{}, false
+	}
+
+	return fields[3], fields[0], fields[1], time.Unix(unix, 0), true
+}
+
+func sign(key []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+func generateNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
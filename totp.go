@@ -0,0 +1,494 @@
+package a1
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"html/template"
+	"image/png"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+
+	"golang.org/x/net/xsrftoken"
+)
+
+// TOTPPath is the default path used for hosting the page (GET) and
+// completing (POST) the second factor of Login once TOTP 2FA is enabled for
+// a user. An alternative path can be passed to LoginTOTP if desired.
+const TOTPPath = "/login/totp"
+
+// pendingTOTPCookieName holds the short-lived, single-purpose cookie Login
+// sets instead of a real session when a user with TOTP enabled submits the
+// correct password.
+const pendingTOTPCookieName = "a1-totp-pending"
+
+// totpPendingAction scopes the xsrftoken used to sign the pending-2fa cookie,
+// so it can't be confused with tokens Client.XSRF generates for forms.
+const totpPendingAction = "totp-pending"
+
+// totpPendingTimeout bounds how long a user has to enter their code after
+// Login accepts their password, before they must start over.
+const totpPendingTimeout = 5 * time.Minute
+
+// totpRecoveryCodes is a count of recovery codes. GenerateRecoveryCodes does
+// not read it: it creates exactly the n codes its caller asks for.
+const totpRecoveryCodes = 10
+
+// totpRecoveryCodeLen is the length of the codes generateRecoveryCode
+// produces, used by looksLikeRecoveryCode to tell a recovery code from an
+// ordinary 6-digit TOTP code by shape alone.
+const totpRecoveryCodeLen = 10
+
+// EnrollTOTP generates a random TOTP secret for username and persists it as
+// a pending secret through the Client's UserStore (which must implement
+// TOTPStore), returning it along with an otpauth://totp/... URL suitable
+// for rendering as a QR code (see TOTPQRCode) in an authenticator app. It
+// does not enable 2FA - ConfirmTOTP must be called with a code generated
+// from the returned secret first - and calling it again before that
+// confirmation is idempotent, returning the same pending secret rather than
+// silently replacing it (and any recovery codes already generated for it).
+// Once ConfirmTOTP succeeds, pair it with GenerateRecoveryCodes so the user
+// has a way back in if they lose their device.
+func (c *Client) EnrollTOTP(username string) (secret, otpauthURL string, err error) {
+	store, ok := c.store.(TOTPStore)
+	if !ok {
+		return "", "", fmt.Errorf("a1: UserStore does not support TOTP")
+	}
+
+	if existing, enabled, err := store.LookupTOTP(username); err == nil && existing != "" {
+		if enabled {
+			return "", "", fmt.Errorf("a1: TOTP already enabled for %q", username)
+		}
+		return existing, totpKeyURL(c.totpIssuer, username, existing), nil
+	}
+
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      c.totpIssuer,
+		AccountName: username,
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	if err := store.SetTOTP(username, key.Secret()); err != nil {
+		return "", "", err
+	}
+	return key.Secret(), key.URL(), nil
+}
+
+// ConfirmTOTP verifies code against username's pending TOTP secret (set by
+// EnrollTOTP) and, if it matches, enables 2FA via the UserStore's
+// EnableTOTP. Until it succeeds, LookupTOTP reports enabled=false and Login
+// won't challenge the user for a second factor.
+func (c *Client) ConfirmTOTP(username, code string) error {
+	store, ok := c.store.(TOTPStore)
+	if !ok {
+		return fmt.Errorf("a1: UserStore does not support TOTP")
+	}
+
+	secret, enabled, err := store.LookupTOTP(username)
+	if err != nil {
+		return err
+	}
+	if enabled {
+		return fmt.Errorf("a1: TOTP already enabled for %q", username)
+	}
+	if secret == "" {
+		return fmt.Errorf("a1: no pending TOTP enrollment for %q", username)
+	}
+
+	counter, ok := validateTOTPCode(secret, code, 0)
+	if !ok {
+		return fmt.Errorf("a1: invalid TOTP code")
+	}
+	if err := store.SetLastTOTPCounter(username, counter); err != nil {
+		return err
+	}
+	return store.EnableTOTP(username)
+}
+
+// GenerateRecoveryCodes creates n fresh one-time-use recovery codes for
+// username, replacing any that existed before, and persists their hashes
+// (via c's Hasher) through the UserStore. It returns the plaintext codes,
+// which the caller must show the user now - they cannot be recovered later,
+// only replaced.
+func (c *Client) GenerateRecoveryCodes(username string, n int) ([]string, error) {
+	store, ok := c.store.(TOTPStore)
+	if !ok {
+		return nil, fmt.Errorf("a1: UserStore does not support TOTP")
+	}
+
+	codes := make([]string, n)
+	hashes := make([]string, n)
+	for i := range codes {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		hash, err := c.hasher.Hash(code)
+		if err != nil {
+			return nil, err
+		}
+		codes[i], hashes[i] = code, hash
+	}
+
+	if err := store.SetRecoveryCodeHashes(username, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// TOTPEnrollPage returns a page showing username's secret as both text and a
+// QR code (served from qrPath, e.g. mounted at TOTPQRCode) for scanning into
+// an authenticator app, along with a form that POSTs the resulting code to
+// confirmPath (mount Client.TOTPConfirm there) to confirm enrollment and
+// actually enable 2FA. Mount it behind EnsureAuth.
+func (c *Client) TOTPEnrollPage(qrPath, confirmPath string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, ok := c.Username(r)
+		if !ok {
+			httpError(w, 401)
+			return
+		}
+
+		secret, otpauthURL, err := c.EnrollTOTP(username)
+		if err != nil {
+			httpError(w, 500, err)
+			return
+		}
+
+		t := template.Must(compileTemplates(resource("totp.html")))
+		_ = t.Execute(w, struct {
+			Secret      string
+			OTPAuthURL  string
+			QRPath      string
+			ConfirmPath string
+			Token       string
+		}{secret, otpauthURL, qrPath, confirmPath, c.XSRF(confirmPath)})
+	})
+}
+
+// TOTPConfirm returns a handler that completes the enrollment TOTPEnrollPage
+// started: it verifies the XSRF token and 6-digit code POSTed (as by
+// TOTPEnrollPage's form) against the authenticated user's pending TOTP
+// secret, enabling 2FA via ConfirmTOTP if it matches. Mount it at
+// confirmPath, behind EnsureAuth.
+func (c *Client) TOTPConfirm(confirmPath string) http.Handler {
+	return c.CheckXSRF(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, ok := c.Username(r)
+		if !ok {
+			httpError(w, 401)
+			return
+		}
+
+		if err := c.ConfirmTOTP(username, r.PostFormValue("code")); err != nil {
+			httpError(w, 401, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}), confirmPath)
+}
+
+// TOTPQRCode returns a handler that serves a PNG QR code encoding the
+// authenticated user's otpauth URL, for scanning into an authenticator app
+// during enrollment (see TOTPEnrollPage). Mount it behind EnsureAuth.
+func (c *Client) TOTPQRCode() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, ok := c.Username(r)
+		if !ok {
+			httpError(w, 401)
+			return
+		}
+
+		store, ok := c.store.(TOTPStore)
+		if !ok {
+			httpError(w, 500, errors.New("a1: UserStore does not support TOTP"))
+			return
+		}
+		secret, _, err := store.LookupTOTP(username)
+		if err != nil || secret == "" {
+			httpError(w, 404, errors.New("a1: TOTP not enrolled"))
+			return
+		}
+
+		key, err := otp.NewKeyFromURL(totpKeyURL(c.totpIssuer, username, secret))
+		if err != nil {
+			httpError(w, 500, err)
+			return
+		}
+		img, err := key.Image(256, 256)
+		if err != nil {
+			httpError(w, 500, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "image/png")
+		_ = png.Encode(w, img)
+	})
+}
+
+// totpKeyURL builds the otpauth://totp/... URL for secret, in the same shape
+// EnrollTOTP's call to totp.Generate produces, so TOTPQRCode can reconstruct
+// a user's QR code from just their stored secret.
+func totpKeyURL(issuer, username, secret string) string {
+	label := username
+	if issuer != "" {
+		label = issuer + ":" + username
+	}
+	v := url.Values{}
+	v.Set("secret", secret)
+	if issuer != "" {
+		v.Set("issuer", issuer)
+	}
+	u := url.URL{Scheme: "otpauth", Host: "totp", Path: "/" + label, RawQuery: v.Encode()}
+	return u.String()
+}
+
+// TOTPLoginPage returns a page whose form POSTs to LoginTOTP, prompting the
+// user for their 6-digit (or recovery) code. By default TOTPPath is used for
+// verifying XSRF, but an alternative may be passed in through the path
+// parameter - it must match whatever is passed to LoginTOTP. If the
+// pending-2fa cookie Login set carries a "next" value, it's also rendered as
+// a hidden field; LoginTOTP itself takes next from the cookie, not the form.
+func (c *Client) TOTPLoginPage(path ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		totpPath := TOTPPath
+		if len(path) > 0 && path[0] != "" {
+			totpPath = path[0]
+		}
+
+		next := ""
+		if cookie, err := r.Cookie(pendingTOTPCookieName); err == nil {
+			if _, n, ok := c.verifyPendingTOTP(cookie.Value); ok {
+				next = n
+			}
+		}
+
+		t := template.Must(compileTemplates(resource("totp-login.html")))
+		_ = t.Execute(w, struct {
+			TOTPPath string
+			Token    string
+			Next     string
+		}{totpPath, c.XSRF(totpPath), next})
+	})
+}
+
+// LoginTOTP completes the second half of Login for a user with TOTP 2FA
+// enabled: it verifies the pending-2fa cookie Login set and the 6-digit code
+// (or a recovery code) POSTed against it, then issues the same kind of
+// session cookie Login issues on success. By default, TOTPPath is used for
+// verifying XSRF and users are redirected to RedirectPath, but alternatives
+// may be passed in through the paths parameter, as with Login. If the
+// pending-2fa cookie carries a "next" value (because Login's POST included
+// one), users are redirected there instead, same as Login.
+func (c *Client) LoginTOTP(paths ...string) http.Handler {
+	totpPath, redirectPath := TOTPPath, RedirectPath
+	if len(paths) >= 1 {
+		if paths[0] != "" {
+			totpPath = paths[0]
+		}
+		if len(paths) > 1 && paths[1] != "" {
+			redirectPath = paths[1]
+		}
+	}
+
+	// TOTP codes are much shorter-lived and lower-entropy than passwords, so
+	// we rate limit attempts more aggressively.
+	return RateLimit(5.0/60.0, c.CheckXSRF(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			httpError(w, 500, errors.New("login request must use POST"))
+			return
+		}
+
+		cookie, err := r.Cookie(pendingTOTPCookieName)
+		if err != nil {
+			httpError(w, 401, errors.New("a1: no pending TOTP login"))
+			return
+		}
+		username, next, ok := c.verifyPendingTOTP(cookie.Value)
+		if !ok {
+			httpError(w, 401, errors.New("a1: invalid or expired pending TOTP login"))
+			return
+		}
+
+		store, ok := c.store.(TOTPStore)
+		if !ok {
+			httpError(w, 500, errors.New("a1: UserStore does not support TOTP"))
+			return
+		}
+
+		if err := c.checkTOTP(store, username, r.PostFormValue("code")); err != nil {
+			httpError(w, 401, err)
+			return
+		}
+		http.SetCookie(w, clearedCookie(pendingTOTPCookieName))
+
+		expires := time.Now().AddDate(0, 0, 30)
+		token, err := c.backend.New(username, "", expires)
+		if err != nil {
+			httpError(w, 500, err)
+			return
+		}
+		http.SetCookie(w, buildCookie(token, expires))
+
+		if next := c.safeNext(next); next != "" {
+			redirectPath = next
+		}
+		http.Redirect(w, r, redirectPath, 302)
+	}), totpPath))
+}
+
+// pendingTOTPCookie builds the short-lived cookie Login sets for username
+// once their password has been verified, ahead of the TOTP challenge. next
+// (already validated by safeNext) is carried along so LoginTOTP can honor it
+// on success just as Login would have; it rides unsigned in the cookie since
+// verifyPendingTOTP's caller re-validates it with safeNext before use.
+func (c *Client) pendingTOTPCookie(username, next string) *http.Cookie {
+	token := xsrftoken.Generate(c.xsrfKey, username, totpPendingAction)
+	return &http.Cookie{
+		Name:     pendingTOTPCookieName,
+		Value:    url.QueryEscape(next) + "|" + url.QueryEscape(username) + ":" + token,
+		HttpOnly: true,
+		Path:     "/",
+		Expires:  time.Now().Add(totpPendingTimeout),
+	}
+}
+
+// verifyPendingTOTP validates a pendingTOTPCookie's value and returns the
+// username and next path it was issued for.
+func (c *Client) verifyPendingTOTP(value string) (username, next string, ok bool) {
+	escapedNext, rest, ok := strings.Cut(value, "|")
+	if !ok {
+		return "", "", false
+	}
+	next, err := url.QueryUnescape(escapedNext)
+	if err != nil {
+		return "", "", false
+	}
+	escapedUsername, token, ok := strings.Cut(rest, ":")
+	if !ok {
+		return "", "", false
+	}
+	username, err = url.QueryUnescape(escapedUsername)
+	if err != nil {
+		return "", "", false
+	}
+	if !xsrftoken.ValidFor(token, c.xsrfKey, username, totpPendingAction, totpPendingTimeout) {
+		return "", "", false
+	}
+	return username, next, true
+}
+
+// checkTOTP validates code for username against a recovery code first (if
+// code has the shape generateRecoveryCode produces - an ordinary 6-digit
+// TOTP code never does, so this skips a needless hasher.Verify pass on every
+// login), then an RFC 6238 TOTP code (SHA-1, 30s step, +/-1 window),
+// guarding against replay by rejecting any counter at or before the last
+// one accepted.
+func (c *Client) checkTOTP(store TOTPStore, username, code string) error {
+	if looksLikeRecoveryCode(code) {
+		if ok, err := c.consumeRecoveryCode(store, username, code); err == nil && ok {
+			return nil
+		}
+	}
+
+	secret, enabled, err := store.LookupTOTP(username)
+	if err != nil {
+		return err
+	}
+	if !enabled {
+		return fmt.Errorf("a1: TOTP not enabled for %q", username)
+	}
+	last, err := store.LastTOTPCounter(username)
+	if err != nil {
+		return err
+	}
+
+	counter, ok := validateTOTPCode(secret, code, last)
+	if !ok {
+		return fmt.Errorf("a1: invalid TOTP code")
+	}
+	return store.SetLastTOTPCounter(username, counter)
+}
+
+// validateTOTPCode checks code against secret as an RFC 6238 TOTP code
+// (SHA-1, 30s step, +/-1 window), returning the counter it matched - always
+// greater than after, so callers can reject replays by passing the last
+// counter they accepted.
+func validateTOTPCode(secret, code string, after uint64) (counter uint64, ok bool) {
+	now := uint64(time.Now().Unix()) / 30
+	for _, skew := range []int64{0, -1, 1} {
+		c := int64(now) + skew
+		if c <= int64(after) {
+			continue
+		}
+		valid, err := totp.ValidateCustom(code, secret, time.Unix(c*30, 0), totp.ValidateOpts{
+			Period:    30,
+			Skew:      0,
+			Digits:    otp.DigitsSix,
+			Algorithm: otp.AlgorithmSHA1,
+		})
+		if err == nil && valid {
+			return uint64(c), true
+		}
+	}
+	return 0, false
+}
+
+// consumeRecoveryCode checks code against username's unused recovery code
+// hashes, removing the matching one (so it can't be reused) if found.
+func (c *Client) consumeRecoveryCode(store TOTPStore, username, code string) (bool, error) {
+	hashes, err := store.RecoveryCodeHashes(username)
+	if err != nil {
+		return false, err
+	}
+	for i, hash := range hashes {
+		if verifyHash(hash, code) == nil {
+			remaining := append(append([]string(nil), hashes[:i]...), hashes[i+1:]...)
+			return true, store.SetRecoveryCodeHashes(username, remaining)
+		}
+	}
+	return false, nil
+}
+
+// clearedCookie builds a cookie that instructs the browser to delete name.
+func clearedCookie(name string) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    "",
+		HttpOnly: true,
+		Path:     "/",
+		Expires:  time.Unix(0, 0),
+	}
+}
+
+// looksLikeRecoveryCode reports whether code has the shape
+// generateRecoveryCode produces (totpRecoveryCodeLen decimal digits), which
+// an ordinary 6-digit TOTP code never does.
+func looksLikeRecoveryCode(code string) bool {
+	if len(code) != totpRecoveryCodeLen {
+		return false
+	}
+	for _, r := range code {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// generateRecoveryCode returns a random 10-digit recovery code.
+func generateRecoveryCode() (string, error) {
+	max := big.NewInt(10000000000)
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%010d", n), nil
+}
@@ -0,0 +1,230 @@
+package a1
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// TOTPStore is implemented by UserStores that support TOTP-based 2FA (see
+// EnrollTOTP and Client.LoginTOTP). It is kept separate from UserStore so
+// stores that don't need 2FA aren't forced to implement it.
+type TOTPStore interface {
+	// LookupTOTP returns username's TOTP secret and whether 2FA is enabled,
+	// or an error if no such user exists. A store that only tracks enrolled
+	// users, like FileTOTPStore, instead returns an empty secret, enabled
+	// false and a nil error for any other username. A secret may exist (returned) with
+	// enabled false: EnrollTOTP stores it pending confirmation by ConfirmTOTP
+	// before Login will actually challenge the user for it.
+	LookupTOTP(username string) (secret string, enabled bool, err error)
+	// SetTOTP stores secret as username's pending TOTP secret, replacing any
+	// previous one. It does not itself enable 2FA; see EnableTOTP.
+	SetTOTP(username, secret string) error
+	// EnableTOTP enables 2FA for username, who must already have a pending
+	// secret set via SetTOTP. Called by ConfirmTOTP once a code generated
+	// from that secret has been verified.
+	EnableTOTP(username string) error
+	// LastTOTPCounter returns the RFC 6238 counter of the last code accepted
+	// for username (0 if none has been accepted yet), so Client.LoginTOTP can
+	// guard against replaying a code.
+	LastTOTPCounter(username string) (uint64, error)
+	// SetLastTOTPCounter records the counter of the most recently accepted
+	// code for username.
+	SetLastTOTPCounter(username string, counter uint64) error
+	// RecoveryCodeHashes returns username's unused recovery code hashes.
+	RecoveryCodeHashes(username string) ([]string, error)
+	// SetRecoveryCodeHashes replaces username's unused recovery code hashes.
+	SetRecoveryCodeHashes(username string, hashes []string) error
+}
+
+// totpRecord is the state FileTOTPStore keeps per enrolled user.
+type totpRecord struct {
+	secret         string
+	enabled        bool
+	counter        uint64
+	recoveryHashes []string
+}
+
+// FileTOTPStore is a TOTPStore backed by a file of
+// "username:secret:enabled:counter:hash1,hash2,..." lines, one per enrolled
+// user, modeled on FileUserStore. It is safe for concurrent use, and every
+// write is flushed back to disk immediately.
+type FileTOTPStore struct {
+	path string
+
+	lock  sync.Mutex
+	users map[string]*totpRecord
+}
+
+// NewFileTOTPStore loads a FileTOTPStore from path, creating an empty file if
+// one does not already exist.
+func NewFileTOTPStore(path string) (*FileTOTPStore, error) {
+	s := &FileTOTPStore{path: path, users: map[string]*totpRecord{}}
+	f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 5)
+		if len(parts) != 5 {
+			return nil, fmt.Errorf("a1: malformed line in %s: %q", path, line)
+		}
+		enabled, err := strconv.ParseBool(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("a1: malformed enabled flag in %s: %q", path, line)
+		}
+		counter, err := strconv.ParseUint(parts[3], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("a1: malformed counter in %s: %q", path, line)
+		}
+		var hashes []string
+		if parts[4] != "" {
+			hashes = strings.Split(parts[4], ",")
+		}
+		s.users[parts[0]] = &totpRecord{secret: parts[1], enabled: enabled, counter: counter, recoveryHashes: hashes}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// LookupTOTP implements TOTPStore.
+func (s *FileTOTPStore) LookupTOTP(username string) (string, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	r, ok := s.users[username]
+	if !ok {
+		return "", false, nil
+	}
+	return r.secret, r.enabled, nil
+}
+
+// SetTOTP implements TOTPStore.
+func (s *FileTOTPStore) SetTOTP(username, secret string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.users[username] = &totpRecord{secret: secret}
+	return s.save()
+}
+
+// EnableTOTP implements TOTPStore.
+func (s *FileTOTPStore) EnableTOTP(username string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	r, ok := s.users[username]
+	if !ok || r.secret == "" {
+		return fmt.Errorf("a1: no pending TOTP secret for %q", username)
+	}
+	r.enabled = true
+	return s.save()
+}
+
+// LastTOTPCounter implements TOTPStore.
+func (s *FileTOTPStore) LastTOTPCounter(username string) (uint64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	r, ok := s.users[username]
+	if !ok {
+		return 0, fmt.Errorf("a1: unknown TOTP user %q", username)
+	}
+	return r.counter, nil
+}
+
+// SetLastTOTPCounter implements TOTPStore.
+func (s *FileTOTPStore) SetLastTOTPCounter(username string, counter uint64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	r, ok := s.users[username]
+	if !ok {
+		return fmt.Errorf("a1: unknown TOTP user %q", username)
+	}
+	r.counter = counter
+	return s.save()
+}
+
+// RecoveryCodeHashes implements TOTPStore.
+func (s *FileTOTPStore) RecoveryCodeHashes(username string) ([]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	r, ok := s.users[username]
+	if !ok {
+		return nil, fmt.Errorf("a1: unknown TOTP user %q", username)
+	}
+	return append([]string(nil), r.recoveryHashes...), nil
+}
+
+// SetRecoveryCodeHashes implements TOTPStore.
+func (s *FileTOTPStore) SetRecoveryCodeHashes(username string, hashes []string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	r, ok := s.users[username]
+	if !ok {
+		return fmt.Errorf("a1: unknown TOTP user %q", username)
+	}
+	r.recoveryHashes = hashes
+	return s.save()
+}
+
+// save rewrites the underlying file with the current contents of s.users.
+// Callers must hold s.lock.
+func (s *FileTOTPStore) save() error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	for username, r := range s.users {
+		if _, err := fmt.Fprintf(w, "%s:%s:%t:%d:%s\n",
+			username, r.secret, r.enabled, r.counter, strings.Join(r.recoveryHashes, ",")); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// FileUserTOTPStore composes a FileUserStore with a FileTOTPStore into a
+// single store that satisfies both UserStore and TOTPStore (plus UserAdder
+// and UserRemover, via the embedded FileUserStore) - the ready-made store
+// for a deployment that wants both multi-user password auth and TOTP 2FA
+// (see EnrollTOTP), since neither FileUserStore nor FileTOTPStore alone
+// implements both.
+type FileUserTOTPStore struct {
+	*FileUserStore
+	*FileTOTPStore
+}
+
+// NewFileUserTOTPStore loads a FileUserTOTPStore from userPath and totpPath
+// (see NewFileUserStore and NewFileTOTPStore respectively), creating either
+// file if it does not already exist.
+func NewFileUserTOTPStore(userPath, totpPath string) (*FileUserTOTPStore, error) {
+	users, err := NewFileUserStore(userPath)
+	if err != nil {
+		return nil, err
+	}
+	totp, err := NewFileTOTPStore(totpPath)
+	if err != nil {
+		return nil, err
+	}
+	return &FileUserTOTPStore{users, totp}, nil
+}
@@ -0,0 +1,148 @@
+package a1
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// UserStore looks up password hashes by username on behalf of a Client. It is
+// the extension point used by New to support more than one user; see
+// FileUserStore for a ready-made file-backed implementation.
+type UserStore interface {
+	// Lookup returns the stored hash for username, or an error if no such
+	// user exists.
+	Lookup(username string) (hash []byte, err error)
+	// List returns the usernames known to the store.
+	List() ([]string, error)
+}
+
+// UserAdder is implemented by UserStores that support adding or updating a
+// user's hash. It is kept separate from UserStore so read-only stores don't
+// need to implement it.
+type UserAdder interface {
+	Add(username string, hash []byte) error
+}
+
+// UserRemover is implemented by UserStores that support removing a user. It
+// is kept separate from UserStore so read-only stores don't need to
+// implement it.
+type UserRemover interface {
+	Remove(username string) error
+}
+
+// singleUserStore adapts a single hash (the original New(hash) behavior)
+// into a UserStore of exactly one, unnamed user.
+type singleUserStore struct {
+	hash []byte
+}
+
+func (s *singleUserStore) Lookup(username string) ([]byte, error) {
+	return s.hash, nil
+}
+
+func (s *singleUserStore) List() ([]string, error) {
+	return []string{""}, nil
+}
+
+// FileUserStore is a UserStore backed by a file of "username:hash" lines, one
+// per user, modeled on /etc/shadow. It is safe for concurrent use, and every
+// Add/Remove is flushed back to disk immediately.
+type FileUserStore struct {
+	path string
+
+	lock  sync.Mutex
+	users map[string][]byte
+}
+
+// NewFileUserStore loads a FileUserStore from path, creating an empty file if
+// one does not already exist.
+func NewFileUserStore(path string) (*FileUserStore, error) {
+	s := &FileUserStore{path: path, users: map[string][]byte{}}
+	f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("a1: malformed line in %s: %q", path, line)
+		}
+		s.users[parts[0]] = []byte(parts[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Lookup implements UserStore.
+func (s *FileUserStore) Lookup(username string) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	hash, ok := s.users[username]
+	if !ok {
+		return nil, fmt.Errorf("a1: unknown user %q", username)
+	}
+	return hash, nil
+}
+
+// List implements UserStore.
+func (s *FileUserStore) List() ([]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	users := make([]string, 0, len(s.users))
+	for username := range s.users {
+		users = append(users, username)
+	}
+	return users, nil
+}
+
+// Add implements UserAdder, creating username if it doesn't exist or
+// overwriting its hash if it does.
+func (s *FileUserStore) Add(username string, hash []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.users[username] = hash
+	return s.save()
+}
+
+// Remove implements UserRemover.
+func (s *FileUserStore) Remove(username string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.users, username)
+	return s.save()
+}
+
+// save rewrites the underlying file with the current contents of s.users.
+// Callers must hold s.lock.
+func (s *FileUserStore) save() error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	for username, hash := range s.users {
+		if _, err := fmt.Fprintf(w, "%s:%s\n", username, hash); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}